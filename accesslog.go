@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogFormat selects how access log lines are rendered.
+type accessLogFormat string
+
+const (
+	AccessLogCLF  accessLogFormat = "clf"  // Common Log Format
+	AccessLogJSON accessLogFormat = "json" // newline-delimited JSON
+	AccessLogOff  accessLogFormat = "off"  // no access logging
+)
+
+// parseAccessLogFormat validates a -access-log-format flag value.
+func parseAccessLogFormat(s string) (accessLogFormat, error) {
+	switch accessLogFormat(s) {
+	case AccessLogCLF, AccessLogJSON, AccessLogOff:
+		return accessLogFormat(s), nil
+	default:
+		return "", fmt.Errorf("invalid -access-log-format value %q, must be one of clf, json, off", s)
+	}
+}
+
+// logEntryCtxKey is the context key under which the Director stashes a
+// per-request *accessLogEntry, so the access log middleware (which wraps
+// the ReverseProxy from the outside) can learn what the Director did to
+// the request it cloned.
+type logEntryCtxKey struct{}
+
+// accessLogEntry carries the fields the Director can see but the
+// surrounding http.Handler cannot: the body size it read and the
+// Content-Type it produced.
+type accessLogEntry struct {
+	OriginalContentType  string
+	RewrittenContentType string
+	ReqBodySize          int
+}
+
+// accessLogger writes one line per request to a file or stdout, in CLF or
+// JSON, and can reopen its target on SIGUSR1 for log rotation. Every
+// logged request is also published, as a JSON frame, to hub (if non-nil)
+// for the admin /ws/logs endpoint, regardless of the file format chosen.
+type accessLogger struct {
+	format accessLogFormat
+	target string // "", "stdout", or a file path
+	hub    *logHub
+
+	mu  sync.Mutex
+	out *os.File
+}
+
+// newAccessLogger opens target (or stdout) unless format is AccessLogOff.
+func newAccessLogger(format accessLogFormat, target string, hub *logHub) (*accessLogger, error) {
+	al := &accessLogger{format: format, target: target, hub: hub}
+	if format == AccessLogOff {
+		return al, nil
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// open (re)opens al.target. Caller must hold al.mu, except at construction
+// time when no other goroutine can yet be using al.
+func (al *accessLogger) open() error {
+	if al.target == "" || al.target == "stdout" {
+		al.out = os.Stdout
+		return nil
+	}
+	f, err := os.OpenFile(al.target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening access log %s: %w", al.target, err)
+	}
+	al.out = f
+	return nil
+}
+
+// Reopen closes and reopens the log file, for rotation via SIGUSR1. It is
+// a no-op when logging to stdout or when logging is off.
+func (al *accessLogger) Reopen() error {
+	if al.format == AccessLogOff || al.target == "" || al.target == "stdout" {
+		return nil
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.out != nil {
+		al.out.Close()
+	}
+	return al.open()
+}
+
+// statusResponseWriter wraps an http.ResponseWriter to capture the status
+// code and the number of bytes written. It forwards Hijack and Flush to
+// the embedded writer so wrapping it doesn't break the ReverseProxy's
+// WebSocket upgrades or incremental flushing of streamed responses.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Hijack lets a wrapped statusResponseWriter still satisfy http.Hijacker,
+// which httputil.ReverseProxy requires to switch protocols (e.g. WebSocket).
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter %T does not support hijacking", w.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+// Flush lets a wrapped statusResponseWriter still satisfy http.Flusher,
+// which the ReverseProxy needs to flush streamed/chunked responses
+// incrementally instead of buffering them until the handler returns.
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware wraps next, timing each request and emitting one access log
+// line once the response has been written.
+func (al *accessLogger) Middleware(next http.Handler) http.Handler {
+	if al.format == AccessLogOff && al.hub == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &accessLogEntry{OriginalContentType: strings.Join(r.Header.Values("Content-Type"), ", ")}
+		r = r.WithContext(context.WithValue(r.Context(), logEntryCtxKey{}, entry))
+		sw := &statusResponseWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		al.log(r, sw, time.Since(start), entry)
+	})
+}
+
+func (al *accessLogger) log(r *http.Request, sw *statusResponseWriter, d time.Duration, entry *accessLogEntry) {
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	rec := map[string]interface{}{
+		"time":                 time.Now().Format(time.RFC3339),
+		"remoteAddr":           r.RemoteAddr,
+		"method":               r.Method,
+		"url":                  r.URL.String(),
+		"origContentType":      entry.OriginalContentType,
+		"rewrittenContentType": entry.RewrittenContentType,
+		"reqBodySize":          entry.ReqBodySize,
+		"status":               status,
+		"respSize":             sw.size,
+		"durationMs":           float64(d) / float64(time.Millisecond),
+	}
+	data, err := json.Marshal(rec)
+	if al.hub != nil && err == nil {
+		al.hub.Publish(data)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.out == nil {
+		return
+	}
+	switch al.format {
+	case AccessLogJSON:
+		if err == nil {
+			al.out.Write(append(data, '\n'))
+		}
+	case AccessLogCLF:
+		fmt.Fprintf(al.out, "%s - - [%s] %q %d %d %q %q %.3f\n",
+			clfHost(r.RemoteAddr),
+			time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+			fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto),
+			status, sw.size,
+			entry.OriginalContentType, entry.RewrittenContentType,
+			d.Seconds())
+	}
+}
+
+// clfHost strips the port from a host:port address for the CLF host field,
+// falling back to the raw value if it isn't in host:port form.
+func clfHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
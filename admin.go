@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// logHub fans out access log frames to connected /ws/logs subscribers,
+// dropping frames for subscribers that fall behind rather than blocking
+// the request path.
+type logHub struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+// newLogHub creates an empty hub.
+func newLogHub() *logHub {
+	return &logHub{subs: make(map[chan []byte]struct{})}
+}
+
+// Subscribe registers a new subscriber channel.
+func (h *logHub) Subscribe() chan []byte {
+	ch := make(chan []byte, 16)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe removes and closes a subscriber channel.
+func (h *logHub) Unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+	close(ch)
+}
+
+// Publish fans frame out to every current subscriber.
+func (h *logHub) Publish(frame []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- frame:
+		default: // subscriber too slow: drop rather than stall the request
+		}
+	}
+}
+
+// adminMetrics holds the Prometheus collectors exposed on /metrics.
+type adminMetrics struct {
+	requestsTotal   *prometheus.CounterVec
+	inFlight        prometheus.Gauge
+	rewriteSuccess  prometheus.Counter
+	rewriteFailure  prometheus.Counter
+	upstreamLatency prometheus.Histogram
+}
+
+// newAdminMetrics creates and registers the typeproxy collectors against
+// the default Prometheus registry.
+func newAdminMetrics() *adminMetrics {
+	m := &adminMetrics{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "typeproxy_requests_total",
+			Help: "Total proxied requests, by response status.",
+		}, []string{"status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "typeproxy_requests_in_flight",
+			Help: "Requests currently being proxied.",
+		}),
+		rewriteSuccess: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "typeproxy_body_rewrite_success_total",
+			Help: "Body rewrites that applied their rule successfully.",
+		}),
+		rewriteFailure: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "typeproxy_body_rewrite_failure_total",
+			Help: "Body rewrites that fell back to passthrough.",
+		}),
+		upstreamLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "typeproxy_upstream_latency_seconds",
+			Help:    "Latency of proxied requests as observed by typeproxy.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	prometheus.MustRegister(m.requestsTotal, m.inFlight, m.rewriteSuccess, m.rewriteFailure, m.upstreamLatency)
+	return m
+}
+
+// Middleware wraps next, tracking in-flight count, status-coded request
+// totals and upstream latency.
+func (m *adminMetrics) Middleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+		sw := &statusResponseWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requestsTotal.WithLabelValues(strconv.Itoa(status)).Inc()
+		m.upstreamLatency.Observe(time.Since(start).Seconds())
+	})
+}
+
+// adminServer exposes operational endpoints on a listener entirely
+// separate from the proxied traffic, so it's never reachable upstream.
+type adminServer struct {
+	mux   *http.ServeMux
+	token string
+	rules *ruleEngine
+	hub   *logHub
+}
+
+const (
+	wsWriteWait  = 10 * time.Second    // time allowed to write a single frame
+	wsPongWait   = 60 * time.Second    // time allowed to read the next pong before giving up on the peer
+	wsPingPeriod = wsPongWait * 9 / 10 // keep this under wsPongWait so pings always arrive in time
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The admin listener is operator-only and gated by -admin-token, so
+	// the origin check that matters is the bearer token, not Origin.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// newAdminServer builds the admin mux. token, if non-empty, is required as
+// a Bearer Authorization header on every request.
+func newAdminServer(token string, rules *ruleEngine, hub *logHub) *adminServer {
+	a := &adminServer{mux: http.NewServeMux(), token: token, rules: rules, hub: hub}
+	a.mux.HandleFunc("/healthz", a.healthz)
+	a.mux.HandleFunc("/readyz", a.readyz)
+	a.mux.Handle("/metrics", promhttp.Handler())
+	a.mux.HandleFunc("/rules", a.handleRules)
+	a.mux.HandleFunc("/ws/logs", a.handleWSLogs)
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return a
+}
+
+// ServeHTTP enforces the bearer token, when configured, before dispatching
+// to the admin mux.
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" && r.Header.Get("Authorization") != "Bearer "+a.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *adminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func (a *adminServer) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// handleRules serves the active rule set and accepts a reload trigger.
+func (a *adminServer) handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(a.rules.Rules()); err != nil {
+			log.Println("Error encoding rules:", err.Error())
+		}
+	case http.MethodPost:
+		if err := a.rules.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWSLogs upgrades the connection and streams access log frames to it
+// until the client disconnects. Gorilla only processes control frames
+// (close, pong) while a read is in flight, so a read pump runs alongside
+// the write loop purely to drain them and notice a dead peer - this
+// endpoint never expects incoming data frames.
+func (a *adminServer) handleWSLogs(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Error upgrading /ws/logs:", err.Error())
+		return
+	}
+	defer conn.Close()
+	ch := a.hub.Subscribe()
+	defer a.hub.Unsubscribe(ch)
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// adminAddr formats the admin listener address, or "" if port is 0
+// (meaning the admin listener is disabled).
+func adminAddr(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprintf(":%d", port)
+}
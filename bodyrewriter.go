@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// TYPEPROXY_MAX_REWRITE_BYTES is the default -max-rewrite-bytes value: the
+// largest request body bodyRewriter will buffer in order to apply a rule,
+// before falling back to passthrough.
+const TYPEPROXY_MAX_REWRITE_BYTES = 1 << 20 // 1 MiB
+
+// TYPEPROXY_ENV_MAX_REWRITE_BYTES names the env var read as a default for
+// -max-rewrite-bytes.
+const TYPEPROXY_ENV_MAX_REWRITE_BYTES = "TYPEPROXY_MAX_REWRITE_BYTES"
+
+// bodyRewriter applies a Rule's body transform to an *http.Request,
+// buffering at most maxBytes of body so a pathological request can't
+// exhaust memory. Buffers are pooled to keep rewriting allocation-free on
+// the common path.
+type bodyRewriter struct {
+	maxBytes int64
+	pool     sync.Pool
+}
+
+// newBodyRewriter creates a bodyRewriter that buffers at most maxBytes of
+// request body before falling back to passthrough.
+func newBodyRewriter(maxBytes int64) *bodyRewriter {
+	return &bodyRewriter{
+		maxBytes: maxBytes,
+		pool:     sync.Pool{New: func() interface{} { return new(bytes.Buffer) }},
+	}
+}
+
+// Rewrite rewrites r's body or Content-Type according to rule, returning
+// the number of request body bytes it read (0 for rewrite-header, which
+// never touches the body) and whether the rewrite actually took effect, as
+// opposed to falling back to passthrough. ct is the original, pre-rewrite
+// Content-Type as seen by the client.
+//
+// A body larger than br.maxBytes is never rewritten: it is streamed back
+// onto r.Body untouched, so the upstream still receives it in full.
+func (br *bodyRewriter) Rewrite(r *http.Request, rule Rule, ct string) (reqBodySize int, rewritten bool) {
+	if rule.Action == ActionRewriteHeader {
+		if rule.Header != "" {
+			r.Header.Set("Content-Type", rule.Header)
+			return 0, true
+		}
+		return 0, false
+	}
+	if r.Body == nil {
+		return 0, false
+	}
+
+	buf := br.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer br.pool.Put(buf)
+
+	n, err := buf.ReadFrom(io.LimitReader(r.Body, br.maxBytes+1))
+	if err != nil {
+		r.Body.Close()
+		return 0, false
+	}
+	if n > br.maxBytes {
+		// Too large to buffer safely: replay what we've already consumed
+		// in front of whatever r.Body still has left, so the upstream
+		// sees the original body untouched.
+		buffered := append([]byte(nil), buf.Bytes()...)
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buffered), r.Body))
+		return 0, false
+	}
+	r.Body.Close()
+
+	data := buf.Bytes()
+	reqBodySize = len(data)
+	out := data
+	switch rule.Action {
+	case ActionInjectJSONField:
+		if json.Valid(data) {
+			var content map[string]interface{}
+			if err := json.Unmarshal(data, &content); err == nil {
+				field := rule.Field
+				if field == "" {
+					field = "contentType"
+				}
+				content[field] = ct
+				if marshaled, err := json.Marshal(content); err == nil {
+					out = marshaled
+					rewritten = true
+				}
+			}
+		}
+	case ActionWrapAsJSON:
+		wrapped := struct {
+			ContentType string `json:"contentType"`
+			Body        string `json:"body"`
+		}{ContentType: ct, Body: base64.StdEncoding.EncodeToString(data)}
+		if marshaled, err := json.Marshal(wrapped); err == nil {
+			out = marshaled
+			rewritten = true
+		}
+	case ActionTransformXMLToJSON:
+		if marshaled, err := transformXMLToJSON(data); err == nil {
+			out = marshaled
+			rewritten = true
+		}
+	}
+	if rewritten {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	body := append([]byte(nil), out...)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return reqBodySize, rewritten
+}
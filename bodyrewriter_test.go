@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBodyRewriterRewrite(t *testing.T) {
+	injectRule := Rule{Action: ActionInjectJSONField, Field: "contentType"}
+
+	tests := []struct {
+		name          string
+		body          string
+		rule          Rule
+		ct            string
+		wantRewritten bool
+		wantPassthru  bool // body must come back byte-identical to input
+	}{
+		{
+			name:          "empty body",
+			body:          "",
+			rule:          injectRule,
+			ct:            "text/plain",
+			wantRewritten: false,
+			wantPassthru:  true,
+		},
+		{
+			name:          "non-JSON body",
+			body:          "not json at all",
+			rule:          injectRule,
+			ct:            "text/plain",
+			wantRewritten: false,
+			wantPassthru:  true,
+		},
+		{
+			name:          "JSON array passes through",
+			body:          `[1,2,3]`,
+			rule:          injectRule,
+			ct:            "application/json",
+			wantRewritten: false,
+			wantPassthru:  true,
+		},
+		{
+			name:          "JSON object gets the field injected",
+			body:          `{"a":1}`,
+			rule:          injectRule,
+			ct:            "application/json",
+			wantRewritten: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := newBodyRewriter(TYPEPROXY_MAX_REWRITE_BYTES)
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+
+			n, rewritten := br.Rewrite(r, tt.rule, tt.ct)
+
+			if rewritten != tt.wantRewritten {
+				t.Fatalf("rewritten = %v, want %v", rewritten, tt.wantRewritten)
+			}
+			if n != len(tt.body) {
+				t.Fatalf("reqBodySize = %d, want %d", n, len(tt.body))
+			}
+			got, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("reading rewritten body: %v", err)
+			}
+			if tt.wantPassthru && string(got) != tt.body {
+				t.Fatalf("body = %q, want unchanged %q", got, tt.body)
+			}
+			if r.ContentLength != int64(len(got)) {
+				t.Fatalf("ContentLength = %d, want %d", r.ContentLength, len(got))
+			}
+			if hdr := r.Header.Get("Content-Length"); hdr != strconv.Itoa(len(got)) {
+				t.Fatalf("Content-Length header = %q, want %q", hdr, strconv.Itoa(len(got)))
+			}
+			if tt.wantRewritten {
+				var decoded map[string]interface{}
+				if err := json.Unmarshal(got, &decoded); err != nil {
+					t.Fatalf("rewritten body is not valid JSON: %v", err)
+				}
+				if decoded["contentType"] != tt.ct {
+					t.Fatalf("decoded[\"contentType\"] = %v, want %v", decoded["contentType"], tt.ct)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyRewriterOversizePassthrough(t *testing.T) {
+	body := strings.Repeat("a", 16)
+	br := newBodyRewriter(4) // smaller than the body: forces the oversize path
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rule := Rule{Action: ActionInjectJSONField}
+
+	n, rewritten := br.Rewrite(r, rule, "text/plain")
+	if rewritten {
+		t.Fatal("oversize body must not be rewritten")
+	}
+	if n != 0 {
+		t.Fatalf("reqBodySize = %d, want 0 for an oversize body", n)
+	}
+
+	got, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("reading passthrough body: %v", err)
+	}
+	if string(got) != body {
+		t.Fatalf("body = %q, want unchanged %q", got, body)
+	}
+}
+
+func TestBodyRewriterRewriteHeader(t *testing.T) {
+	br := newBodyRewriter(TYPEPROXY_MAX_REWRITE_BYTES)
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("payload")))
+	rule := Rule{Action: ActionRewriteHeader, Header: "application/xml"}
+
+	n, rewritten := br.Rewrite(r, rule, "text/plain")
+	if n != 0 || !rewritten {
+		t.Fatalf("n, rewritten = %d, %v, want 0, true", n, rewritten)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/xml" {
+		t.Fatalf("Content-Type = %q, want application/xml", ct)
+	}
+	got, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if string(got) != "payload" {
+		t.Fatalf("body = %q, want untouched %q", got, "payload")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TYPEPROXY_ENV_LISTEN_FD names the env var a SIGUSR2 upgrade uses to pass
+// its listening socket to the freshly exec'd process.
+const TYPEPROXY_ENV_LISTEN_FD = "TYPEPROXY_LISTEN_FD"
+
+// grace owns the listener, the active handler and the shutdown lifecycle,
+// so that a SIGHUP can hot-swap the handler without dropping the listener,
+// and a SIGUSR2 can hand the listening socket to a freshly exec'd copy of
+// the binary without dropping in-flight connections.
+type grace struct {
+	rawLn net.Listener // unwrapped listener, used to duplicate its fd on upgrade
+	ln    net.Listener // listener actually served, possibly PROXY-protocol wrapped
+
+	handler atomic.Value // holds http.Handler
+	srv     *http.Server
+
+	done chan struct{}
+	wait sync.WaitGroup
+
+	graceful time.Duration
+}
+
+// newGrace opens addr and wraps it, unless a socket was inherited from a
+// SIGUSR2 upgrade via TYPEPROXY_ENV_LISTEN_FD, in which case that listener
+// is adopted instead.
+func newGrace(addr string, proxyProtocolIn proxyProtocolMode, h http.Handler, graceful time.Duration) (*grace, error) {
+	rawLn, err := graceListen(addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &grace{
+		rawLn:    rawLn,
+		ln:       newProxyProtocolListener(rawLn, proxyProtocolIn),
+		done:     make(chan struct{}),
+		graceful: graceful,
+	}
+	g.handler.Store(h)
+	g.srv = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			g.Handler().ServeHTTP(w, r)
+		}),
+	}
+	return g, nil
+}
+
+// graceListen opens addr, or adopts the listener inherited through
+// TYPEPROXY_ENV_LISTEN_FD.
+func graceListen(addr string) (net.Listener, error) {
+	if fdStr := os.Getenv(TYPEPROXY_ENV_LISTEN_FD); fdStr != "" {
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", TYPEPROXY_ENV_LISTEN_FD, err)
+		}
+		ln, err := net.FileListener(os.NewFile(uintptr(fd), "typeproxy-inherited"))
+		if err != nil {
+			return nil, fmt.Errorf("adopting inherited listener: %w", err)
+		}
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Handler returns the currently active handler.
+func (g *grace) Handler() http.Handler {
+	return g.handler.Load().(http.Handler)
+}
+
+// SetHandler atomically replaces the active handler; in-flight requests
+// keep running against the handler they started with.
+func (g *grace) SetHandler(h http.Handler) {
+	g.handler.Store(h)
+}
+
+// Serve runs the HTTP server over g's listener until shut down.
+func (g *grace) Serve() error {
+	return g.srv.Serve(g.ln)
+}
+
+// Shutdown gracefully stops the server, waiting up to g.graceful.
+func (g *grace) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), g.graceful)
+	defer cancel()
+	return g.srv.Shutdown(ctx)
+}
+
+// Upgrade forks and execs the running binary, passing the listening
+// socket's file descriptor via ExtraFiles so the new process can start
+// accepting connections immediately while this one drains and exits.
+func (g *grace) Upgrade() (*os.Process, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	fl, ok := g.rawLn.(filer)
+	if !ok {
+		return nil, fmt.Errorf("listener of type %T does not support fd inheritance", g.rawLn)
+	}
+	f, err := fl.File()
+	if err != nil {
+		return nil, fmt.Errorf("duplicating listener fd: %w", err)
+	}
+	defer f.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=3", TYPEPROXY_ENV_LISTEN_FD))
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting upgraded process: %w", err)
+	}
+	return cmd.Process, nil
+}
@@ -1,14 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -18,7 +14,7 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -33,52 +29,89 @@ const (
 	TYPEPROXY_ENV_URL   = "TYPEPROXY_URL"   // Env variable to read for proxy URL
 	TYPEPROXY_ENV_PORT  = "TYPEPROXY_PORT"  // Env variable to read for proxy port
 	TYPEPROXY_ENV_GRACE = "TYPEPROXY_GRACE" // Env variable to read for Grace period
+
+	TYPEPROXY_PROXY_PROTOCOL_IN      = "off" // Default -proxy-protocol-in mode
+	TYPEPROXY_PROXY_PROTOCOL_OUT     = "off" // Default -proxy-protocol-out mode
+	TYPEPROXY_ENV_PROXY_PROTOCOL_IN  = "TYPEPROXY_PROXY_PROTOCOL_IN"
+	TYPEPROXY_ENV_PROXY_PROTOCOL_OUT = "TYPEPROXY_PROXY_PROTOCOL_OUT"
+
+	TYPEPROXY_ENV_RULES = "TYPEPROXY_RULES" // Env variable to read for the rules file path
+
+	TYPEPROXY_ACCESS_LOG_FORMAT     = "clf" // Default -access-log-format
+	TYPEPROXY_ACCESS_LOG            = "stdout"
+	TYPEPROXY_ENV_ACCESS_LOG_FORMAT = "TYPEPROXY_ACCESS_LOG_FORMAT"
+	TYPEPROXY_ENV_ACCESS_LOG        = "TYPEPROXY_ACCESS_LOG"
+
+	TYPEPROXY_ADMIN_PORT      = 0 // Default -admin-port: 0 disables the admin listener
+	TYPEPROXY_ENV_ADMIN_PORT  = "TYPEPROXY_ADMIN_PORT"
+	TYPEPROXY_ENV_ADMIN_TOKEN = "TYPEPROXY_ADMIN_TOKEN"
 )
 
-// newProxy creates reverse proxy that overrides Content-Type on POST
-func newProxy(target *url.URL, timeout, keepalive time.Duration) *httputil.ReverseProxy {
+// maxRewriteBytesMin is the smallest -max-rewrite-bytes value accepted:
+// below this, every body with a Content-Type worth rewriting would
+// routinely overflow it.
+const maxRewriteBytesMin = 1024
+
+// reloadable holds the subset of config a SIGHUP is allowed to change
+// without recreating the listener or admin server. It's swapped as a
+// whole via an atomic.Value (the same pattern grace.go uses for
+// g.handler) so the hups goroutine can publish a new snapshot while
+// buildHandler reads the current one, with no lock and no data race -
+// unlike reassigning config itself, which other goroutines read fields
+// of concurrently (e.g. the shutdown goroutine reads config.Grace).
+type reloadable struct {
+	url              *url.URL
+	proxyProtocolOut proxyProtocolOutMode
+	maxRewriteBytes  int64
+}
+
+// newProxy creates a reverse proxy that rewrites request bodies/headers
+// according to rules. metrics may be nil, in which case rewrite outcomes
+// aren't tracked.
+func newProxy(target *url.URL, timeout, keepalive time.Duration, proxyProtocolOut proxyProtocolOutMode, rules *ruleEngine, rewriter *bodyRewriter, metrics *adminMetrics) *httputil.ReverseProxy {
 	p := httputil.NewSingleHostReverseProxy(target)
 	oldDirector := p.Director
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: keepalive,
+		DualStack: true,
+	}
 	p.Transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   timeout,
-			KeepAlive: keepalive,
-			DualStack: true,
-		}).DialContext,
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: dialContextWithProxyProtocol(dialer.DialContext, proxyProtocolOut),
+		// The PROXY header is written once, at dial time, onto a single
+		// TCP connection. Pooled keep-alive connections get reused across
+		// unrelated clients, so the upstream would see a reused
+		// connection's original header and mis-attribute every request
+		// that rides it afterwards to the wrong source. Disable pooling
+		// whenever we emit that header, so every dial fronts exactly one
+		// client.
+		DisableKeepAlives:     proxyProtocolOut != ProxyProtocolOutOff,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       keepalive,
 		TLSHandshakeTimeout:   timeout,
 		ExpectContinueTimeout: time.Second,
 	}
 	p.Director = func(r *http.Request) {
+		*r = *r.WithContext(context.WithValue(r.Context(), remoteAddrCtxKey{}, r.RemoteAddr))
 		oldDirector(r)
-		// Change POST body content-type to application/json
-		if r.Method == http.MethodPost {
-			ct := strings.Join(r.Header.Values("Content-Type"), ", ")
-			log.Println(r.Proto, r.Method, "Content-Type:", ct, r.URL.String())
-			if r.Body != nil {
-				// Read the whole body
-				data, err := io.ReadAll(r.Body)
-				if !errors.Is(err, io.EOF) {
-					return
-				}
-				r.Body.Close()
-				// If we can decode it as json, add a "contentType" field
-				var content map[string]interface{}
-				dec := json.NewDecoder(bytes.NewReader(data))
-				if err := dec.Decode(&content); err == nil {
-					r.Header.Set("Content-Type", "application/json")
-					content["contentType"] = ct
-					if data, err = json.Marshal(content); err != nil {
-						r.Header.Del("Content-Length") // just in case
-					}
+		ct := strings.Join(r.Header.Values("Content-Type"), ", ")
+		entry, _ := r.Context().Value(logEntryCtxKey{}).(*accessLogEntry)
+		if rule, ok := rules.Match(r); ok {
+			n, rewritten := rewriter.Rewrite(r, rule, ct)
+			if entry != nil {
+				entry.ReqBodySize = n
+			}
+			if metrics != nil {
+				if rewritten {
+					metrics.rewriteSuccess.Inc()
+				} else {
+					metrics.rewriteFailure.Inc()
 				}
-				// Replace the body with whatever we could do
-				r.Body = ioutil.NopCloser(bytes.NewReader(data))
 			}
-		} else {
-			log.Println(r.Proto, r.Method, r.URL.String())
+		}
+		if entry != nil {
+			entry.RewrittenContentType = strings.Join(r.Header.Values("Content-Type"), ", ")
 		}
 	}
 	return p
@@ -86,9 +119,24 @@ func newProxy(target *url.URL, timeout, keepalive time.Duration) *httputil.Rever
 
 // config struct holds configurable params for program
 type config struct {
-	URL   *url.URL // URL to forward traffic to
-	Port  int      // Port to listen on
-	Grace int      // Grace interval duration (seconds)
+	URL              *url.URL // URL to forward traffic to
+	Port             int      // Port to listen on
+	Grace            int      // Grace interval duration (seconds)
+	ProxyProtocolIn  proxyProtocolMode
+	ProxyProtocolOut proxyProtocolOutMode
+	RulesPath        string // Path to the rules file, empty to use defaultRules
+	MaxRewriteBytes  int64  // Largest request body bodyRewriter will buffer to apply a rule
+	AccessLogFormat  accessLogFormat
+	AccessLogTarget  string // Path to the access log file, or "stdout"
+	AdminPort        int    // 0 disables the admin listener
+	AdminToken       string // Bearer token required on the admin listener, if non-empty
+
+	// *FromFlag record whether the corresponding field was pinned by an
+	// explicit flag or positional argument at startup, so a later SIGHUP
+	// knows which fields it's still free to re-read from the environment.
+	urlFromFlag              bool
+	proxyProtocolOutFromFlag bool
+	maxRewriteBytesFromFlag  bool
 }
 
 // newConfig reads config from args or env
@@ -102,15 +150,55 @@ func newConfig() (config, error) {
 	if err != nil {
 		return c, err
 	}
+	defProxyProtocolIn := envString(TYPEPROXY_ENV_PROXY_PROTOCOL_IN, TYPEPROXY_PROXY_PROTOCOL_IN)
+	defProxyProtocolOut := envString(TYPEPROXY_ENV_PROXY_PROTOCOL_OUT, TYPEPROXY_PROXY_PROTOCOL_OUT)
+	defAdminPort, err := envInt(TYPEPROXY_ENV_ADMIN_PORT, TYPEPROXY_ADMIN_PORT)
+	if err != nil {
+		return c, err
+	}
+	defMaxRewriteBytes, err := envInt(TYPEPROXY_ENV_MAX_REWRITE_BYTES, TYPEPROXY_MAX_REWRITE_BYTES)
+	if err != nil {
+		return c, err
+	}
 	flag.IntVar(&c.Port, "port", defPort, fmt.Sprintf("TCP Port to listen to (Env %s)", TYPEPROXY_ENV_PORT))
 	flag.IntVar(&c.Grace, "grace", defGrace, fmt.Sprintf("Grace interval for shutdown (seconds) (Env %s)", TYPEPROXY_ENV_GRACE))
+	proxyProtocolIn := flag.String("proxy-protocol-in", defProxyProtocolIn, fmt.Sprintf("PROXY protocol handling on the listener: off, accept, require (Env %s)", TYPEPROXY_ENV_PROXY_PROTOCOL_IN))
+	proxyProtocolOut := flag.String("proxy-protocol-out", defProxyProtocolOut, fmt.Sprintf("PROXY protocol header to emit to the upstream: off, v1, v2 (Env %s)", TYPEPROXY_ENV_PROXY_PROTOCOL_OUT))
+	flag.StringVar(&c.RulesPath, "rules", envString(TYPEPROXY_ENV_RULES, ""), fmt.Sprintf("Path to a rules file describing body/header rewrites (Env %s)", TYPEPROXY_ENV_RULES))
+	maxRewriteBytes := flag.Int64("max-rewrite-bytes", int64(defMaxRewriteBytes), fmt.Sprintf("Largest request body to buffer for rule rewriting, larger bodies pass through unmodified (Env %s)", TYPEPROXY_ENV_MAX_REWRITE_BYTES))
+	accessLogFormatFlag := flag.String("access-log-format", envString(TYPEPROXY_ENV_ACCESS_LOG_FORMAT, TYPEPROXY_ACCESS_LOG_FORMAT), fmt.Sprintf("Access log format: clf, json, off (Env %s)", TYPEPROXY_ENV_ACCESS_LOG_FORMAT))
+	flag.StringVar(&c.AccessLogTarget, "access-log", envString(TYPEPROXY_ENV_ACCESS_LOG, TYPEPROXY_ACCESS_LOG), fmt.Sprintf("Access log destination: a file path, or \"stdout\" (Env %s)", TYPEPROXY_ENV_ACCESS_LOG))
+	flag.IntVar(&c.AdminPort, "admin-port", defAdminPort, fmt.Sprintf("TCP port for the admin endpoint, 0 to disable (Env %s)", TYPEPROXY_ENV_ADMIN_PORT))
+	flag.StringVar(&c.AdminToken, "admin-token", envString(TYPEPROXY_ENV_ADMIN_TOKEN, ""), fmt.Sprintf("Bearer token required on the admin endpoint, empty to disable auth (Env %s)", TYPEPROXY_ENV_ADMIN_TOKEN))
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "proxy-protocol-out":
+			c.proxyProtocolOutFromFlag = true
+		case "max-rewrite-bytes":
+			c.maxRewriteBytesFromFlag = true
+		}
+	})
+	c.urlFromFlag = flag.NArg() > 0
 	if c.Port < TYPEPROXY_PORT_MIN || c.Port > TYPEPROXY_PORT_MAX {
 		return c, fmt.Errorf("Invalid port number %d, must be between %d and %d", c.Port, TYPEPROXY_PORT_MIN, TYPEPROXY_PORT_MAX)
 	}
 	if c.Grace < TYPEPROXY_GRACE_MIN || c.Grace > TYPEPROXY_GRACE_MAX {
 		return c, fmt.Errorf("Invalid grace interval %d, must be between %d and %d seconds", c.Grace, TYPEPROXY_GRACE_MIN, TYPEPROXY_GRACE_MAX)
 	}
+	if *maxRewriteBytes < maxRewriteBytesMin {
+		return c, fmt.Errorf("Invalid -max-rewrite-bytes %d, must be at least %d", *maxRewriteBytes, maxRewriteBytesMin)
+	}
+	c.MaxRewriteBytes = *maxRewriteBytes
+	if c.ProxyProtocolIn, err = parseProxyProtocolMode(*proxyProtocolIn); err != nil {
+		return c, err
+	}
+	if c.ProxyProtocolOut, err = parseProxyProtocolOutMode(*proxyProtocolOut); err != nil {
+		return c, err
+	}
+	if c.AccessLogFormat, err = parseAccessLogFormat(*accessLogFormatFlag); err != nil {
+		return c, err
+	}
 	var urlString string
 	if flag.NArg() > 0 {
 		urlString = flag.Arg(0)
@@ -126,6 +214,45 @@ func newConfig() (config, error) {
 	return c, nil
 }
 
+// withEnvOverrides returns a copy of c with the URL, -proxy-protocol-out
+// and -max-rewrite-bytes settings re-read from their environment
+// variables, for a SIGHUP reload. A field pinned by an explicit flag or
+// positional argument at startup keeps that value instead: flags win over
+// env vars on every reload, the same way they do on the initial parse.
+// Port, -grace, -proxy-protocol-in, -admin-port and -admin-token are left
+// untouched, since changing them would mean recreating the listener or
+// admin server, which a SIGHUP reload does not do.
+func (c config) withEnvOverrides() (config, error) {
+	next := c
+	if !c.urlFromFlag {
+		if v := envString(TYPEPROXY_ENV_URL, ""); v != "" {
+			u, err := url.Parse(v)
+			if err != nil {
+				return c, err
+			}
+			next.URL = u
+		}
+	}
+	if !c.proxyProtocolOutFromFlag {
+		mode, err := parseProxyProtocolOutMode(envString(TYPEPROXY_ENV_PROXY_PROTOCOL_OUT, TYPEPROXY_PROXY_PROTOCOL_OUT))
+		if err != nil {
+			return c, err
+		}
+		next.ProxyProtocolOut = mode
+	}
+	if !c.maxRewriteBytesFromFlag {
+		n, err := envInt(TYPEPROXY_ENV_MAX_REWRITE_BYTES, TYPEPROXY_MAX_REWRITE_BYTES)
+		if err != nil {
+			return c, err
+		}
+		if int64(n) < maxRewriteBytesMin {
+			return c, fmt.Errorf("invalid %s %d, must be at least %d", TYPEPROXY_ENV_MAX_REWRITE_BYTES, n, maxRewriteBytesMin)
+		}
+		next.MaxRewriteBytes = int64(n)
+	}
+	return next, nil
+}
+
 // Main keeps forwarding traffic
 func main() {
 
@@ -134,39 +261,137 @@ func main() {
 		flag.Usage()
 		log.Fatal(err.Error())
 	}
+	rules, err := newRuleEngine(config.RulesPath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	var dyn atomic.Value // holds a reloadable, refreshed on SIGHUP
+	dyn.Store(reloadable{
+		url:              config.URL,
+		proxyProtocolOut: config.ProxyProtocolOut,
+		maxRewriteBytes:  config.MaxRewriteBytes,
+	})
+	// hub stays nil when the admin listener is disabled, so accessLog's
+	// "off" format actually skips building a record for every request
+	// instead of publishing it to a hub nobody can subscribe to.
+	var hub *logHub
+	if config.AdminPort != 0 {
+		hub = newLogHub()
+	}
+	accessLog, err := newAccessLogger(config.AccessLogFormat, config.AccessLogTarget, hub)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	var metrics *adminMetrics
+	if config.AdminPort != 0 {
+		metrics = newAdminMetrics()
+	}
 	// Timeout and keepalive are derived from grace period interval
 	timeout := time.Duration(config.Grace) * time.Second / 2
 	keepalive := time.Duration(config.Grace) * time.Second * 3
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.Port),
-		Handler: newProxy(config.URL, timeout, keepalive),
+	graceful := time.Duration(config.Grace) * time.Second
+
+	buildHandler := func() http.Handler {
+		d := dyn.Load().(reloadable)
+		rewriter := newBodyRewriter(d.maxRewriteBytes)
+		return metrics.Middleware(accessLog.Middleware(newProxy(d.url, timeout, keepalive, d.proxyProtocolOut, rules, rewriter, metrics)))
+	}
+	g, err := newGrace(fmt.Sprintf(":%d", config.Port), config.ProxyProtocolIn, buildHandler(), graceful)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	var adminSrv *http.Server
+	if config.AdminPort != 0 {
+		admin := newAdminServer(config.AdminToken, rules, hub)
+		adminSrv = &http.Server{Addr: adminAddr(config.AdminPort), Handler: admin}
+		go func() {
+			log.Println("Admin endpoint listening on port", config.AdminPort)
+			if err := adminSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Println("Admin server error:", err.Error())
+			}
+		}()
 	}
 
 	sigs := make(chan os.Signal, 1)
-	done := make(chan struct{})
-	wait := sync.WaitGroup{}
-	wait.Add(1)
+	hups := make(chan os.Signal, 1)
+	upgrades := make(chan os.Signal, 1)
+	rotates := make(chan os.Signal, 1)
+	g.wait.Add(1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(hups, syscall.SIGHUP)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+	signal.Notify(rotates, syscall.SIGUSR1)
 	go func() {
-		defer wait.Done()
+		for range hups {
+			if err := rules.Reload(); err != nil {
+				log.Println("Error reloading rules:", err.Error())
+				continue
+			}
+			next, err := config.withEnvOverrides()
+			if err != nil {
+				log.Println("Error re-reading env vars:", err.Error())
+				continue
+			}
+			dyn.Store(reloadable{
+				url:              next.URL,
+				proxyProtocolOut: next.ProxyProtocolOut,
+				maxRewriteBytes:  next.MaxRewriteBytes,
+			})
+			log.Println("Rules reloaded from", config.RulesPath)
+			g.SetHandler(buildHandler())
+		}
+	}()
+	go func() {
+		for range rotates {
+			if err := accessLog.Reopen(); err != nil {
+				log.Println("Error rotating access log:", err.Error())
+				continue
+			}
+			log.Println("Access log reopened")
+		}
+	}()
+	go func() {
+		for range upgrades {
+			log.Println("Upgrading: forking a new process to take over the listener")
+			proc, err := g.Upgrade()
+			if err != nil {
+				log.Println("Error upgrading:", err.Error())
+				continue
+			}
+			log.Println("Upgraded to pid", proc.Pid, "- draining this process")
+			go func() {
+				if err := g.Shutdown(); err != nil {
+					log.Println("Error during shutdown:", err.Error())
+				}
+			}()
+		}
+	}()
+	go func() {
+		defer g.wait.Done()
 		select {
 		case <-sigs:
 			break
-		case <-done:
+		case <-g.done:
 			break
 		}
 		log.Println("Cancelling server, waiting up to", config.Grace, "seconds")
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(config.Grace))
-		defer cancel()
-		_ = srv.Shutdown(ctx) // ignore shutdown error
+		if err := g.Shutdown(); err != nil {
+			log.Println("Error during shutdown:", err.Error())
+		}
+		if adminSrv != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), graceful)
+			defer cancel()
+			_ = adminSrv.Shutdown(ctx)
+		}
 	}()
 
 	log.Println("Forwarding requests on port", config.Port, "to", config.URL.String())
-	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	if err := g.Serve(); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err.Error())
 	}
-	close(done)
-	wait.Wait()
+	close(g.done)
+	g.wait.Wait()
 }
 
 // envString reads string from environment
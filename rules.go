@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ruleAction names one of the supported body/header rewrite strategies.
+type ruleAction string
+
+const (
+	ActionInjectJSONField    ruleAction = "inject-json-field"     // decode JSON body, add a field
+	ActionWrapAsJSON         ruleAction = "wrap-as-json"          // base64-wrap the raw body under a JSON envelope
+	ActionRewriteHeader      ruleAction = "rewrite-header"        // only touch Content-Type
+	ActionTransformXMLToJSON ruleAction = "transform-xml-to-json" // decode XML body, re-encode as JSON
+)
+
+// Rule matches a subset of incoming requests and describes how their body
+// or Content-Type should be rewritten before being forwarded upstream.
+// Method, Path and ContentType are optional matchers: an empty string
+// matches anything. Path is a glob pattern as understood by path.Match.
+type Rule struct {
+	Method      string     `yaml:"method" json:"method"`
+	Path        string     `yaml:"path" json:"path"`
+	ContentType string     `yaml:"contentType" json:"contentType"`
+	Action      ruleAction `yaml:"action" json:"action"`
+
+	// Field names the JSON field injected by ActionInjectJSONField.
+	// Defaults to "contentType".
+	Field string `yaml:"field" json:"field"`
+
+	// Header is the Content-Type written by ActionRewriteHeader.
+	Header string `yaml:"header" json:"header"`
+}
+
+// defaultRules reproduces typeproxy's original behavior, used whenever no
+// -rules file is configured: inject the original Content-Type into the
+// decoded JSON body of every POST request.
+var defaultRules = []Rule{
+	{Method: http.MethodPost, Action: ActionInjectJSONField, Field: "contentType"},
+}
+
+// ruleEngine holds the active rule set and lets it be swapped atomically,
+// so a SIGHUP-triggered reload never observes a half-updated slice.
+type ruleEngine struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// newRuleEngine loads rules from path, if given, or falls back to
+// defaultRules.
+func newRuleEngine(path string) (*ruleEngine, error) {
+	re := &ruleEngine{path: path}
+	if path == "" {
+		re.rules = defaultRules
+		return re, nil
+	}
+	if err := re.Reload(); err != nil {
+		return nil, err
+	}
+	return re, nil
+}
+
+// Reload re-reads the rules file from disk and swaps it in. If no file was
+// configured, Reload is a no-op.
+func (re *ruleEngine) Reload() error {
+	if re.path == "" {
+		return nil
+	}
+	rules, err := loadRules(re.path)
+	if err != nil {
+		return err
+	}
+	re.mu.Lock()
+	re.rules = rules
+	re.mu.Unlock()
+	return nil
+}
+
+// Match returns the first rule whose method, path glob and Content-Type
+// prefix all match r, short-circuiting on the first hit.
+func (re *ruleEngine) Match(r *http.Request) (Rule, bool) {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	ct := r.Header.Get("Content-Type")
+	for _, rule := range re.rules {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+			continue
+		}
+		if rule.Path != "" {
+			if ok, err := path.Match(rule.Path, r.URL.Path); err != nil || !ok {
+				continue
+			}
+		}
+		if rule.ContentType != "" && !strings.HasPrefix(ct, rule.ContentType) {
+			continue
+		}
+		return rule, true
+	}
+	return Rule{}, false
+}
+
+// Rules returns a copy of the currently active rule set, for inspection
+// through the admin /rules endpoint.
+func (re *ruleEngine) Rules() []Rule {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	rules := make([]Rule, len(re.rules))
+	copy(rules, re.rules)
+	return rules
+}
+
+// loadRules reads and parses a rules file. YAML is assumed unless the file
+// extension is .json.
+func loadRules(p string) ([]Rule, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules file: %w", err)
+	}
+	var rules []Rule
+	if strings.EqualFold(filepath.Ext(p), ".json") {
+		err = json.Unmarshal(data, &rules)
+	} else {
+		err = yaml.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing rules file %s: %w", p, err)
+	}
+	return rules, nil
+}
+
+// xmlNode is a generic container able to unmarshal an arbitrary XML
+// document, used as the input to transformXMLToJSON.
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []xmlNode  `xml:",any"`
+	Content  string     `xml:",chardata"`
+}
+
+// transformXMLToJSON decodes an XML document into a generic map and
+// re-encodes it as JSON, keyed by the root element's tag name.
+func transformXMLToJSON(data []byte) ([]byte, error) {
+	var root xmlNode
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{root.XMLName.Local: xmlNodeToMap(root)}
+	return json.Marshal(doc)
+}
+
+// xmlNodeToMap converts a single xmlNode into a JSON-friendly map,
+// collapsing repeated child tags into arrays the way most XML-to-JSON
+// converters do.
+func xmlNodeToMap(n xmlNode) map[string]interface{} {
+	m := make(map[string]interface{}, len(n.Attrs)+len(n.Children))
+	for _, a := range n.Attrs {
+		m["@"+a.Name.Local] = a.Value
+	}
+	if len(n.Children) == 0 {
+		if text := strings.TrimSpace(n.Content); text != "" {
+			m["#text"] = text
+		}
+		return m
+	}
+	for _, c := range n.Children {
+		child := xmlNodeToMap(c)
+		if existing, ok := m[c.XMLName.Local]; ok {
+			if list, ok := existing.([]interface{}); ok {
+				m[c.XMLName.Local] = append(list, child)
+			} else {
+				m[c.XMLName.Local] = []interface{}{existing, child}
+			}
+		} else {
+			m[c.XMLName.Local] = child
+		}
+	}
+	return m
+}